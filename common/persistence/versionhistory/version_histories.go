@@ -26,9 +26,12 @@ package versionhistory
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	"go.temporal.io/api/serviceerror"
 	historyspb "go.temporal.io/server/api/history/v1"
+	"go.temporal.io/server/common/primitives/timestamp"
 )
 
 // NewVersionHistories create a new instance of VersionHistories.
@@ -43,7 +46,8 @@ func NewVersionHistories(versionHistory *historyspb.VersionHistory) *historyspb.
 	}
 }
 
-// Copy VersionHistories.
+// Copy VersionHistories. Use CanonicalizeVersionHistories instead if the copy also needs
+// deterministic branch ordering.
 func CopyVersionHistories(h *historyspb.VersionHistories) *historyspb.VersionHistories {
 	var histories []*historyspb.VersionHistory
 	for _, history := range h.Histories {
@@ -56,6 +60,70 @@ func CopyVersionHistories(h *historyspb.VersionHistories) *historyspb.VersionHis
 	}
 }
 
+// CanonicalizeVersionHistories returns a copy of h with Histories sorted into a deterministic
+// order keyed on the sequence of (EventId, Version) pairs of each branch, and
+// CurrentVersionHistoryIndex rewritten to point at the same branch in the new ordering. This
+// gives replicas a stable ordering to hash against and makes LCA tie-breaking reproducible
+// regardless of the order branches were originally added in.
+func CanonicalizeVersionHistories(h *historyspb.VersionHistories) *historyspb.VersionHistories {
+	copied := CopyVersionHistories(h)
+	if len(copied.Histories) == 0 {
+		return copied
+	}
+
+	currentHistory, err := GetVersionHistory(copied, copied.CurrentVersionHistoryIndex)
+	if err != nil {
+		// CurrentVersionHistoryIndex is out of range (malformed input off the wire); leave the
+		// copy as-is rather than guessing which branch to treat as current.
+		return copied
+	}
+
+	sort.SliceStable(copied.Histories, func(i, j int) bool {
+		return compareVersionHistoryKey(copied.Histories[i], copied.Histories[j]) < 0
+	})
+
+	for index, history := range copied.Histories {
+		if history == currentHistory {
+			copied.CurrentVersionHistoryIndex = int32(index)
+			break
+		}
+	}
+
+	return copied
+}
+
+// compareVersionHistoryKey orders two VersionHistory branches by comparing their flattened
+// (EventId, Version) sequences lexicographically; a shorter branch that is otherwise a prefix of
+// a longer one sorts first.
+func compareVersionHistoryKey(a, b *historyspb.VersionHistory) int {
+	minLen := len(a.Items)
+	if len(b.Items) < minLen {
+		minLen = len(b.Items)
+	}
+
+	for i := 0; i < minLen; i++ {
+		switch {
+		case a.Items[i].GetEventId() != b.Items[i].GetEventId():
+			return compareInt64(a.Items[i].GetEventId(), b.Items[i].GetEventId())
+		case a.Items[i].GetVersion() != b.Items[i].GetVersion():
+			return compareInt64(a.Items[i].GetVersion(), b.Items[i].GetVersion())
+		}
+	}
+
+	return compareInt64(int64(len(a.Items)), int64(len(b.Items)))
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
 // GetVersionHistory gets the VersionHistory according to index provided.
 func GetVersionHistory(h *historyspb.VersionHistories, index int32) (*historyspb.VersionHistory, error) {
 	if index < 0 || index >= int32(len(h.Histories)) {
@@ -69,6 +137,10 @@ func GetVersionHistory(h *historyspb.VersionHistories, index int32) (*historyspb
 // Returns:
 //   - the index of the newly added VersionHistory
 //   - error if any
+//
+// Stamps the new branch's LastUpdatedTime so PruneVersionHistories has a timestamp to prune on.
+// CopyVersionHistory (version_history.go) propagates LastUpdatedTime for every subsequent copy,
+// so the timestamp survives CopyVersionHistories/CanonicalizeVersionHistories as well.
 func AddVersionHistory(h *historyspb.VersionHistories, v *historyspb.VersionHistory) (int32, error) {
 	if v == nil {
 		return 0, serviceerror.NewInternal("version histories is null.")
@@ -96,6 +168,7 @@ func AddVersionHistory(h *historyspb.VersionHistories, v *historyspb.VersionHist
 	// TODO maybe we need more strict validation
 
 	newVersionHistory := CopyVersionHistory(v)
+	newVersionHistory.LastUpdatedTime = timestamp.TimeNowPtrUtc()
 	h.Histories = append(h.Histories, newVersionHistory)
 	newVersionHistoryIndex := int32(len(h.Histories)) - 1
 
@@ -141,6 +214,55 @@ func AddAndSwitchVersionHistory(h *historyspb.VersionHistories, v *historyspb.Ve
 	return currentBranchChanged, newVersionHistoryIndex, nil
 }
 
+// AddAndSwitchVersionHistoryByStateTransition adds a VersionHistory and switches the current
+// branch if necessary, based primarily on the supplied state-transition versions and falling
+// back to the Version of the last VersionHistoryItem only when the two state-transition versions
+// are equal.
+// Returns:
+//   - if the current branch has been switched or not
+//   - the index of the newly added VersionHistory
+//   - error if any
+//
+// Unlike AddAndSwitchVersionHistory, this is safe to use in the state-based replication stack:
+// a version history can legitimately remain current even with a smaller last-item version, if it
+// is associated with a state transition history with a higher version.
+func AddAndSwitchVersionHistoryByStateTransition(
+	h *historyspb.VersionHistories,
+	v *historyspb.VersionHistory,
+	incomingStateTransitionVersion int64,
+	currentStateTransitionVersion int64,
+) (bool, int32, error) {
+	newVersionHistoryIndex, err := AddVersionHistory(h, v)
+	if err != nil {
+		return false, 0, err
+	}
+
+	currentBranchChanged := false
+	switch {
+	case incomingStateTransitionVersion > currentStateTransitionVersion:
+		currentBranchChanged = true
+	case incomingStateTransitionVersion == currentStateTransitionVersion:
+		newLastItem, err := GetLastVersionHistoryItem(v)
+		if err != nil {
+			return false, 0, err
+		}
+		currentVersionHistory, err := GetVersionHistory(h, h.CurrentVersionHistoryIndex)
+		if err != nil {
+			return false, 0, err
+		}
+		currentLastItem, err := GetLastVersionHistoryItem(currentVersionHistory)
+		if err != nil {
+			return false, 0, err
+		}
+		currentBranchChanged = newLastItem.Version > currentLastItem.Version
+	}
+
+	if currentBranchChanged {
+		h.CurrentVersionHistoryIndex = newVersionHistoryIndex
+	}
+	return currentBranchChanged, newVersionHistoryIndex, nil
+}
+
 // FindLCAVersionHistoryItemAndIndex finds the lowest common ancestor VersionHistory index and corresponding item.
 func FindLCAVersionHistoryItemAndIndex(h *historyspb.VersionHistories, incomingHistory *historyspb.VersionHistory) (*historyspb.VersionHistoryItem, int32, error) {
 	var versionHistoryIndex int32
@@ -192,3 +314,316 @@ func SetCurrentVersionHistoryIndex(h *historyspb.VersionHistories, currentVersio
 func GetCurrentVersionHistory(h *historyspb.VersionHistories) (*historyspb.VersionHistory, error) {
 	return GetVersionHistory(h, h.GetCurrentVersionHistoryIndex())
 }
+
+// PruneOptions controls which branches PruneVersionHistories is allowed to remove.
+type PruneOptions struct {
+	// MaxBranchCount, if positive, keeps only the MaxBranchCount most recently updated branches
+	// (after MaxAge has already been applied), protected branches notwithstanding.
+	MaxBranchCount int
+	// MaxAge, if positive, drops branches whose LastUpdatedTime is older than MaxAge relative to
+	// Now.
+	MaxAge time.Duration
+	// Now is the reference time MaxAge is evaluated against. Defaults to time.Now().UTC() when
+	// zero.
+	Now time.Time
+}
+
+// PruneVersionHistories removes non-current branches from h according to opts and returns the
+// indices (in the original, pre-pruning numbering) of the branches that were removed.
+// CurrentVersionHistoryIndex is re-mapped to account for the removal.
+//
+// A branch is never removed if it is the current branch, or if its last item lies on the current
+// branch's ancestor path (i.e. the current branch was forked from it); pruning is always a no-op
+// with respect to the current branch.
+func PruneVersionHistories(h *historyspb.VersionHistories, opts PruneOptions) ([]int32, error) {
+	currentHistory, err := GetVersionHistory(h, h.CurrentVersionHistoryIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now().UTC()
+	}
+
+	protected := func(index int32, history *historyspb.VersionHistory) (bool, error) {
+		if index == h.CurrentVersionHistoryIndex {
+			return true, nil
+		}
+		lastItem, err := GetLastVersionHistoryItem(history)
+		if err != nil {
+			return false, err
+		}
+		return ContainsVersionHistoryItem(currentHistory, lastItem), nil
+	}
+
+	keep := make([]bool, len(h.Histories))
+	isProtected := make([]bool, len(h.Histories))
+	for index, history := range h.Histories {
+		keep[index] = true
+		isProtected[index], err = protected(int32(index), history)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxAge > 0 {
+		for index, history := range h.Histories {
+			if isProtected[index] || history.GetLastUpdatedTime() == nil {
+				continue
+			}
+			if now.Sub(timestamp.TimeValue(history.GetLastUpdatedTime())) > opts.MaxAge {
+				keep[index] = false
+			}
+		}
+	}
+
+	if opts.MaxBranchCount > 0 {
+		var candidates []int32
+		survivingProtected := 0
+		for index := range h.Histories {
+			if !keep[index] {
+				continue
+			}
+			if isProtected[index] {
+				survivingProtected++
+				continue
+			}
+			candidates = append(candidates, int32(index))
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			ti := timestamp.TimeValue(h.Histories[candidates[i]].GetLastUpdatedTime())
+			tj := timestamp.TimeValue(h.Histories[candidates[j]].GetLastUpdatedTime())
+			return ti.After(tj)
+		})
+
+		allowance := opts.MaxBranchCount - survivingProtected
+		if allowance < 0 {
+			allowance = 0
+		}
+		for i, index := range candidates {
+			if i >= allowance {
+				keep[index] = false
+			}
+		}
+	}
+
+	var removed []int32
+	var remaining []*historyspb.VersionHistory
+	oldToNew := make(map[int32]int32, len(h.Histories))
+	for index, history := range h.Histories {
+		if !keep[index] {
+			removed = append(removed, int32(index))
+			continue
+		}
+		oldToNew[int32(index)] = int32(len(remaining))
+		remaining = append(remaining, history)
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	newCurrentIndex, ok := oldToNew[h.CurrentVersionHistoryIndex]
+	if !ok {
+		// unreachable: the current branch is always protected above.
+		return nil, serviceerror.NewInternal("pruning version histories must not remove the current branch.")
+	}
+
+	h.Histories = remaining
+	h.CurrentVersionHistoryIndex = newCurrentIndex
+
+	return removed, nil
+}
+
+// versionHistoryTransitionPoint is the version that takes effect at one VersionHistoryItem of a
+// branch; the sequence of these across a branch's items is non-decreasing, which is what makes
+// binary search over them valid.
+type versionHistoryTransitionPoint struct {
+	version int64
+}
+
+// versionHistoryTransitionPoints returns, in ascending order, the version at which each
+// VersionHistoryItem in v begins.
+func versionHistoryTransitionPoints(v *historyspb.VersionHistory) []versionHistoryTransitionPoint {
+	points := make([]versionHistoryTransitionPoint, len(v.Items))
+	for i, item := range v.Items {
+		points[i] = versionHistoryTransitionPoint{version: item.GetVersion()}
+	}
+	return points
+}
+
+// VersionHistoriesIndex is an opt-in, prebuilt index over a VersionHistories snapshot that
+// replaces the linear scan in FindLCAVersionHistoryItem with a binary search over each branch's
+// precomputed, sorted version values, for callers that run many LCA lookups against the same
+// VersionHistories.
+//
+// The index is a point-in-time snapshot: it must be rebuilt via BuildVersionHistoriesIndex
+// whenever the underlying VersionHistories is mutated.
+type VersionHistoriesIndex struct {
+	histories   []*historyspb.VersionHistory
+	transitions [][]versionHistoryTransitionPoint
+}
+
+// BuildVersionHistoriesIndex builds a VersionHistoriesIndex over h.
+func BuildVersionHistoriesIndex(h *historyspb.VersionHistories) *VersionHistoriesIndex {
+	transitions := make([][]versionHistoryTransitionPoint, len(h.Histories))
+	for i, history := range h.Histories {
+		transitions[i] = versionHistoryTransitionPoints(history)
+	}
+
+	return &VersionHistoriesIndex{
+		histories:   h.Histories,
+		transitions: transitions,
+	}
+}
+
+// FindLCA finds the lowest common ancestor VersionHistoryItem and the index of the local branch
+// it was found on. Tie-breaking semantics match FindLCAVersionHistoryItemAndIndex: the LCA item
+// with the higher event ID wins, and equal event IDs are broken in favor of the shorter local
+// branch.
+func (idx *VersionHistoriesIndex) FindLCA(incoming *historyspb.VersionHistory) (*historyspb.VersionHistoryItem, int32, error) {
+	incomingPoints := versionHistoryTransitionPoints(incoming)
+
+	var bestIndex int32
+	var bestLength int32
+	var bestItem *historyspb.VersionHistoryItem
+
+	for i, localHistory := range idx.histories {
+		item, err := idx.findLCA(i, incoming, incomingPoints)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if bestItem == nil ||
+			item.GetEventId() > bestItem.GetEventId() ||
+			(item.GetEventId() == bestItem.GetEventId() && int32(len(localHistory.Items)) < bestLength) {
+
+			bestIndex = int32(i)
+			bestLength = int32(len(localHistory.Items))
+			bestItem = item
+		}
+	}
+
+	return CopyVersionHistoryItem(bestItem), bestIndex, nil
+}
+
+// FindLCABatch computes FindLCA for every incoming history, reusing the prebuilt index across
+// all of them instead of rebuilding it once per incoming history.
+func (idx *VersionHistoriesIndex) FindLCABatch(incomings []*historyspb.VersionHistory) ([]*historyspb.VersionHistoryItem, []int32, error) {
+	items := make([]*historyspb.VersionHistoryItem, len(incomings))
+	indexes := make([]int32, len(incomings))
+
+	for i, incoming := range incomings {
+		item, index, err := idx.FindLCA(incoming)
+		if err != nil {
+			return nil, nil, err
+		}
+		items[i] = item
+		indexes[i] = index
+	}
+
+	return items, indexes, nil
+}
+
+// findLCA finds the LCA between the local branch at branchIndex and incoming by binary searching
+// the local branch's precomputed transition points instead of linearly scanning its items, per
+// FindLCAVersionHistoryItem's two-pointer merge.
+func (idx *VersionHistoriesIndex) findLCA(
+	branchIndex int,
+	incoming *historyspb.VersionHistory,
+	incomingPoints []versionHistoryTransitionPoint,
+) (*historyspb.VersionHistoryItem, error) {
+	localHistory := idx.histories[branchIndex]
+	localPoints := idx.transitions[branchIndex]
+
+	li, ri := len(localPoints)-1, len(incomingPoints)-1
+	for li >= 0 && ri >= 0 {
+		localVersion := localPoints[li].version
+		incomingVersion := incomingPoints[ri].version
+
+		switch {
+		case localVersion == incomingVersion:
+			localItem := localHistory.Items[li]
+			incomingItem := incoming.Items[ri]
+			if localItem.GetEventId() < incomingItem.GetEventId() {
+				return CopyVersionHistoryItem(localItem), nil
+			}
+			return CopyVersionHistoryItem(incomingItem), nil
+		case localVersion > incomingVersion:
+			// binary search for the last local transition point with version <= incomingVersion.
+			li = sort.Search(li+1, func(k int) bool { return localPoints[k].version > incomingVersion }) - 1
+		default:
+			// binary search for the last incoming transition point with version <= localVersion.
+			ri = sort.Search(ri+1, func(k int) bool { return incomingPoints[k].version > localVersion }) - 1
+		}
+	}
+
+	return nil, serviceerror.NewInternal("version history is malformed. No joint point found.")
+}
+
+// IsAncestorOf returns true if ancestor is a prefix of descendant, i.e. descendant was forked
+// from (or is identical to) ancestor's last item.
+func IsAncestorOf(ancestor, descendant *historyspb.VersionHistory) bool {
+	lastAncestorItem, err := GetLastVersionHistoryItem(ancestor)
+	if err != nil {
+		return false
+	}
+	return ContainsVersionHistoryItem(descendant, lastAncestorItem)
+}
+
+// CommonPrefixLength returns the event ID through which a and b share identical history, i.e. the
+// event ID of their lowest common ancestor item.
+func CommonPrefixLength(a, b *historyspb.VersionHistory) (int64, error) {
+	item, err := FindLCAVersionHistoryItem(a, b)
+	if err != nil {
+		return 0, err
+	}
+	return item.GetEventId(), nil
+}
+
+// NegotiateCommonHistory pairs every local branch against every remote branch, computes the LCA
+// of each pair, and returns the indices of the pair whose LCA has the highest event ID - the
+// highest common prefix the two sides can both replay. Ties are broken in favor of the pair whose
+// LCA item has the highest version.
+func NegotiateCommonHistory(
+	local *historyspb.VersionHistories,
+	remote *historyspb.VersionHistories,
+) (int32, int32, *historyspb.VersionHistoryItem, error) {
+	if len(local.Histories) == 0 || len(remote.Histories) == 0 {
+		return 0, 0, nil, serviceerror.NewInternal("version histories must not be empty.")
+	}
+
+	var bestLocalIndex, bestRemoteIndex int32
+	var bestItem *historyspb.VersionHistoryItem
+	var lastErr error
+
+	for localIndex, localHistory := range local.Histories {
+		for remoteIndex, remoteHistory := range remote.Histories {
+			item, err := FindLCAVersionHistoryItem(localHistory, remoteHistory)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			if bestItem == nil ||
+				item.GetEventId() > bestItem.GetEventId() ||
+				(item.GetEventId() == bestItem.GetEventId() && item.GetVersion() > bestItem.GetVersion()) {
+
+				bestLocalIndex = int32(localIndex)
+				bestRemoteIndex = int32(remoteIndex)
+				bestItem = item
+			}
+		}
+	}
+
+	if bestItem == nil {
+		if lastErr != nil {
+			return 0, 0, nil, fmt.Errorf("no common version history found between local and remote: %w", lastErr)
+		}
+		return 0, 0, nil, serviceerror.NewInternal("no common version history found between local and remote.")
+	}
+
+	return bestLocalIndex, bestRemoteIndex, CopyVersionHistoryItem(bestItem), nil
+}
@@ -0,0 +1,219 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package versionhistory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	historyspb "go.temporal.io/server/api/history/v1"
+	"go.temporal.io/server/common/primitives/timestamp"
+)
+
+type versionHistoriesSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func TestVersionHistoriesSuite(t *testing.T) {
+	suite.Run(t, new(versionHistoriesSuite))
+}
+
+func (s *versionHistoriesSuite) SetupTest() {
+	s.Assertions = require.New(s.T())
+}
+
+func (s *versionHistoriesSuite) TestCanonicalizeVersionHistories_OutOfRangeCurrentIndexIsNoop() {
+	h := &historyspb.VersionHistories{
+		CurrentVersionHistoryIndex: 3,
+		Histories: []*historyspb.VersionHistory{
+			NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+				NewVersionHistoryItem(5, 1),
+			}),
+		},
+	}
+
+	s.NotPanics(func() {
+		canonical := CanonicalizeVersionHistories(h)
+		s.Equal(int32(3), canonical.CurrentVersionHistoryIndex)
+	})
+}
+
+func (s *versionHistoriesSuite) TestCanonicalizeVersionHistories_PreservesLastUpdatedTimeForPruning() {
+	h := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+	}))
+
+	oldBranch := NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(2, 2),
+	})
+	_, err := AddVersionHistory(h, oldBranch)
+	s.NoError(err)
+	// Backdate the non-current branch so it is eligible for TTL-based pruning.
+	h.Histories[1].LastUpdatedTime = timestamp.TimePtr(time.Now().UTC().Add(-2 * time.Hour))
+
+	canonical := CanonicalizeVersionHistories(h)
+	canonicalOldBranch, err := GetVersionHistory(canonical, 1)
+	s.NoError(err)
+	s.NotNil(canonicalOldBranch.GetLastUpdatedTime(), "CopyVersionHistory must propagate LastUpdatedTime")
+
+	removed, err := PruneVersionHistories(canonical, PruneOptions{MaxAge: time.Hour})
+	s.NoError(err)
+	s.NotEmpty(removed, "canonicalize must preserve LastUpdatedTime for TTL-based pruning to work")
+}
+
+func (s *versionHistoriesSuite) TestAddAndSwitchVersionHistoryByStateTransition_StateTransitionVersionWins() {
+	h := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(10, 2),
+	}))
+
+	// Incoming branch's last item has a smaller version (1) than the current branch's last item,
+	// but its state-transition version is larger, so it must still become current.
+	incoming := NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(5, 1),
+	})
+
+	switched, index, err := AddAndSwitchVersionHistoryByStateTransition(h, incoming, 10, 5)
+	s.NoError(err)
+	s.True(switched)
+	s.Equal(int32(1), index)
+	s.Equal(int32(1), h.CurrentVersionHistoryIndex)
+}
+
+func (s *versionHistoriesSuite) TestAddAndSwitchVersionHistoryByStateTransition_TieFallsBackToLastItemVersion() {
+	h := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(10, 1),
+	}))
+
+	incoming := NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(5, 2),
+	})
+
+	switched, index, err := AddAndSwitchVersionHistoryByStateTransition(h, incoming, 10, 10)
+	s.NoError(err)
+	s.True(switched)
+	s.Equal(int32(1), index)
+}
+
+func (s *versionHistoriesSuite) TestAddAndSwitchVersionHistoryByStateTransition_TieAndLowerVersionDoesNotSwitch() {
+	h := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(10, 2),
+	}))
+
+	incoming := NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(1, 1),
+		NewVersionHistoryItem(5, 1),
+	})
+
+	switched, _, err := AddAndSwitchVersionHistoryByStateTransition(h, incoming, 10, 10)
+	s.NoError(err)
+	s.False(switched)
+	s.Equal(int32(0), h.CurrentVersionHistoryIndex)
+}
+
+func (s *versionHistoriesSuite) TestVersionHistoriesIndex_FindLCA_MatchesLinearImplementation() {
+	h := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(5, 1),
+		NewVersionHistoryItem(9, 2),
+		NewVersionHistoryItem(14, 2),
+		NewVersionHistoryItem(20, 3),
+	}))
+	_, err := AddVersionHistory(h, NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(5, 1),
+		NewVersionHistoryItem(9, 2),
+		NewVersionHistoryItem(16, 2),
+		NewVersionHistoryItem(22, 4),
+	}))
+	s.NoError(err)
+	_, err = AddVersionHistory(h, NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(5, 1),
+		NewVersionHistoryItem(7, 1),
+	}))
+	s.NoError(err)
+
+	incomings := []*historyspb.VersionHistory{
+		NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+			NewVersionHistoryItem(5, 1),
+			NewVersionHistoryItem(9, 2),
+			NewVersionHistoryItem(12, 2),
+		}),
+		NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+			NewVersionHistoryItem(5, 1),
+			NewVersionHistoryItem(6, 1),
+		}),
+		NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+			NewVersionHistoryItem(5, 1),
+			NewVersionHistoryItem(9, 2),
+			NewVersionHistoryItem(16, 2),
+			NewVersionHistoryItem(30, 4),
+		}),
+	}
+
+	index := BuildVersionHistoriesIndex(h)
+	for _, incoming := range incomings {
+		wantItem, wantIndex, err := FindLCAVersionHistoryItemAndIndex(h, incoming)
+		s.NoError(err)
+
+		gotItem, gotIndex, err := index.FindLCA(incoming)
+		s.NoError(err)
+
+		s.Equal(wantIndex, gotIndex)
+		s.Equal(wantItem, gotItem)
+	}
+
+	gotItems, gotIndexes, err := index.FindLCABatch(incomings)
+	s.NoError(err)
+	for i, incoming := range incomings {
+		wantItem, wantIndex, err := FindLCAVersionHistoryItemAndIndex(h, incoming)
+		s.NoError(err)
+		s.Equal(wantIndex, gotIndexes[i])
+		s.Equal(wantItem, gotItems[i])
+	}
+}
+
+func (s *versionHistoriesSuite) TestNegotiateCommonHistory_WrapsUnderlyingErrorWhenNoPairSucceeds() {
+	// These branches' first items disagree on version, so FindLCAVersionHistoryItem fails for
+	// the only pair with a malformed-history error rather than a genuine "no common ancestor".
+	local := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(5, 2),
+	}))
+	remote := NewVersionHistories(NewVersionHistory(nil, []*historyspb.VersionHistoryItem{
+		NewVersionHistoryItem(5, 1),
+	}))
+
+	_, _, _, err := NegotiateCommonHistory(local, remote)
+	s.Error(err)
+	s.Contains(err.Error(), "no common version history found")
+	s.Contains(err.Error(), "No joint point found")
+}
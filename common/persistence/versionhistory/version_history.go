@@ -0,0 +1,132 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package versionhistory
+
+import (
+	"go.temporal.io/api/serviceerror"
+	historyspb "go.temporal.io/server/api/history/v1"
+)
+
+// NewVersionHistoryItem create a new instance of VersionHistoryItem.
+func NewVersionHistoryItem(eventID int64, version int64) *historyspb.VersionHistoryItem {
+	if eventID < 0 || version < 0 {
+		panic("invalid version history item")
+	}
+
+	return &historyspb.VersionHistoryItem{
+		EventId: eventID,
+		Version: version,
+	}
+}
+
+// NewVersionHistory create a new instance of VersionHistory.
+func NewVersionHistory(branchToken []byte, items []*historyspb.VersionHistoryItem) *historyspb.VersionHistory {
+	return &historyspb.VersionHistory{
+		BranchToken: branchToken,
+		Items:       items,
+	}
+}
+
+// CopyVersionHistoryItem copy a VersionHistoryItem.
+func CopyVersionHistoryItem(item *historyspb.VersionHistoryItem) *historyspb.VersionHistoryItem {
+	return &historyspb.VersionHistoryItem{
+		EventId: item.GetEventId(),
+		Version: item.GetVersion(),
+	}
+}
+
+// CopyVersionHistory copy a VersionHistory.
+func CopyVersionHistory(v *historyspb.VersionHistory) *historyspb.VersionHistory {
+	token := make([]byte, len(v.GetBranchToken()))
+	copy(token, v.GetBranchToken())
+
+	var items []*historyspb.VersionHistoryItem
+	for _, item := range v.Items {
+		items = append(items, CopyVersionHistoryItem(item))
+	}
+
+	return &historyspb.VersionHistory{
+		BranchToken:     token,
+		Items:           items,
+		LastUpdatedTime: v.GetLastUpdatedTime(),
+	}
+}
+
+// GetFirstVersionHistoryItem gets the first VersionHistoryItem.
+func GetFirstVersionHistoryItem(v *historyspb.VersionHistory) (*historyspb.VersionHistoryItem, error) {
+	if len(v.Items) == 0 {
+		return nil, serviceerror.NewInternal("version history is empty.")
+	}
+	return CopyVersionHistoryItem(v.Items[0]), nil
+}
+
+// GetLastVersionHistoryItem gets the last VersionHistoryItem.
+func GetLastVersionHistoryItem(v *historyspb.VersionHistory) (*historyspb.VersionHistoryItem, error) {
+	if len(v.Items) == 0 {
+		return nil, serviceerror.NewInternal("version history is empty.")
+	}
+	return CopyVersionHistoryItem(v.Items[len(v.Items)-1]), nil
+}
+
+// ContainsVersionHistoryItem check whether VersionHistory contains given version history item.
+func ContainsVersionHistoryItem(v *historyspb.VersionHistory, item *historyspb.VersionHistoryItem) bool {
+	for _, currentItem := range v.Items {
+		if item.GetVersion() == currentItem.GetVersion() {
+			return item.GetEventId() <= currentItem.GetEventId()
+		} else if item.GetVersion() < currentItem.GetVersion() {
+			return false
+		}
+	}
+	return false
+}
+
+// FindLCAVersionHistoryItem finds the lowest common ancestor VersionHistoryItem of two
+// VersionHistory branches. If the two branches agree on a version but disagree on the event ID
+// reached under it, the lower event ID is the LCA.
+func FindLCAVersionHistoryItem(
+	localVersionHistory *historyspb.VersionHistory,
+	remoteVersionHistory *historyspb.VersionHistory,
+) (*historyspb.VersionHistoryItem, error) {
+	localIndex := len(localVersionHistory.Items) - 1
+	remoteIndex := len(remoteVersionHistory.Items) - 1
+
+	for localIndex >= 0 && remoteIndex >= 0 {
+		localVersionItem := localVersionHistory.Items[localIndex]
+		remoteVersionItem := remoteVersionHistory.Items[remoteIndex]
+
+		if localVersionItem.GetVersion() == remoteVersionItem.GetVersion() {
+			if localVersionItem.GetEventId() < remoteVersionItem.GetEventId() {
+				return CopyVersionHistoryItem(localVersionItem), nil
+			}
+			return CopyVersionHistoryItem(remoteVersionItem), nil
+		} else if localVersionItem.GetVersion() > remoteVersionItem.GetVersion() {
+			localIndex--
+		} else {
+			remoteIndex--
+		}
+	}
+
+	return nil, serviceerror.NewInternal("version history is malformed. No joint point found.")
+}